@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type cacheEntry struct {
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+	Body         []byte `json:"body"`
+}
+
+// httpCache is a minimal on-disk conditional-GET cache, one JSON file per URL under dir.
+type httpCache struct {
+	dir     string
+	mu      sync.Mutex
+	entries map[string]*cacheEntry // keyed by URL
+}
+
+func newHTTPCache(dir string) *httpCache {
+	return &httpCache{dir: dir, entries: make(map[string]*cacheEntry)}
+}
+
+func cacheKey(url string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(url)))
+}
+
+// sanitizeCacheURL strips private_token before a URL is used as a cache key
+// or written to disk, so -cache-dir entries never persist the live token.
+func sanitizeCacheURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	q.Del("private_token")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (c *httpCache) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	files, err := ioutil.ReadDir(c.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(c.dir, f.Name()))
+		if err != nil {
+			log.Printf("Failed to read cache entry %s: %s", f.Name(), err)
+			continue
+		}
+
+		var stored struct {
+			URL   string     `json:"url"`
+			Entry cacheEntry `json:"entry"`
+		}
+		if err := json.Unmarshal(data, &stored); err != nil {
+			log.Printf("Failed to decode cache entry %s: %s", f.Name(), err)
+			continue
+		}
+
+		entry := stored.Entry
+		c.entries[stored.URL] = &entry
+	}
+
+	return nil
+}
+
+func (c *httpCache) get(url string) (*cacheEntry, bool) {
+	url = sanitizeCacheURL(url)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.entries[url]
+	return entry, found
+}
+
+func (c *httpCache) put(url string, entry *cacheEntry) error {
+	url = sanitizeCacheURL(url)
+
+	c.mu.Lock()
+	c.entries[url] = entry
+	c.mu.Unlock()
+
+	if c.dir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+
+	stored := struct {
+		URL   string     `json:"url"`
+		Entry cacheEntry `json:"entry"`
+	}{URL: url, Entry: *entry}
+
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(c.dir, cacheKey(url)+".json")
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (c *httpCache) applyConditionalHeaders(req *http.Request, url string) {
+	entry, found := c.get(url)
+	if !found {
+		return
+	}
+
+	if entry.ETag != "" {
+		req.Header.Set("If-None-Match", entry.ETag)
+	}
+	if entry.LastModified != "" {
+		req.Header.Set("If-Modified-Since", entry.LastModified)
+	}
+}
+
+// primeEventChecksums seeds checksums from cached events without appending to
+// _NewOrModifiedEvents, so a restart doesn't reprint them.
+func primeEventChecksums(events []Event) {
+	_EventsMutex.Lock()
+	defer _EventsMutex.Unlock()
+
+	for _, event := range events {
+		hash, err := checksumEvent(event)
+		if err != nil {
+			log.Printf("Failed to marshal cached event for checksum: kind=%s id=%d err=%s", event.Kind(), event.ID(), err)
+			continue
+		}
+		_EventChecksumsByID[eventKey{Kind: event.Kind(), ID: event.ID()}] = checksumRecord{
+			Hash:      hash,
+			CreatedAt: event.CreatedAt(),
+			ProjectID: eventProjectID(event),
+		}
+	}
+}
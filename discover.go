@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	discover         = flag.Bool("discover", false, "Expand group: targets into their projects, recursively across subgroups")
+	discoverInterval = flag.Duration("discover-interval", 5*time.Minute, "How often to re-discover newly created projects in watched groups")
+)
+
+type targetKind int
+
+const (
+	targetProject targetKind = iota
+	targetGroup
+	targetUser
+)
+
+// target is a parsed positional CLI argument: project:123, group:456 or user:someone.
+type target struct {
+	kind targetKind
+	id   int64
+	name string
+}
+
+func parseTarget(s string) (target, error) {
+	switch {
+	case strings.HasPrefix(s, "project:"):
+		id, err := strconv.ParseInt(strings.TrimPrefix(s, "project:"), 10, 64)
+		return target{kind: targetProject, id: id}, err
+	case strings.HasPrefix(s, "group:"):
+		id, err := strconv.ParseInt(strings.TrimPrefix(s, "group:"), 10, 64)
+		return target{kind: targetGroup, id: id}, err
+	case strings.HasPrefix(s, "user:"):
+		return target{kind: targetUser, name: strings.TrimPrefix(s, "user:")}, nil
+	default:
+		id, err := strconv.ParseInt(s, 10, 64)
+		return target{kind: targetProject, id: id}, err
+	}
+}
+
+// discoverGroupProjects walks every page of a group's projects, including subgroups.
+func discoverGroupProjects(groupID int64) ([]Project, error) {
+	var projects []Project
+
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("https://%s/api/v4/groups/%d/projects?include_subgroups=true&simple=true&per_page=100&page=%d&private_token=%s",
+			*gitlabURL, groupID, page, *token)
+
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return projects, err
+		}
+
+		_, body, err := doGet(req)
+		if err != nil {
+			return projects, err
+		}
+
+		var pageProjects []Project
+		if err = json.Unmarshal(body, &pageProjects); err != nil {
+			return projects, err
+		}
+		if len(pageProjects) == 0 {
+			break
+		}
+		projects = append(projects, pageProjects...)
+	}
+
+	return projects, nil
+}
+
+// watchGroup spawns a watchProject goroutine per project in the group, re-discovering periodically.
+func watchGroup(groupID int64) {
+	watched := make(map[int64]bool)
+	var mu sync.Mutex
+
+	rediscover := func() {
+		projects, err := discoverGroupProjects(groupID)
+		if err != nil {
+			log.Printf("Failed to discover projects for group=%d: %s", groupID, err)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for i := range projects {
+			project := projects[i]
+			if watched[project.ID] {
+				continue
+			}
+			watched[project.ID] = true
+			log.Printf("Discovered projectID=%d in group=%d", project.ID, groupID)
+			go watchProject(&project)
+		}
+	}
+
+	rediscover()
+	for range time.Tick(*discoverInterval) {
+		rediscover()
+	}
+}
+
+// resolveUserID looks up a GitLab numeric user ID from a username.
+func resolveUserID(username string) (int64, error) {
+	escapedUsername := url.QueryEscape(username)
+	reqURL := fmt.Sprintf("https://%s/api/v4/users?username=%s&private_token=%s", *gitlabURL, escapedUsername, *token)
+
+	req, err := http.NewRequest("GET", reqURL, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	_, body, err := doGet(req)
+	if err != nil {
+		return 0, err
+	}
+
+	var users []struct {
+		ID int64
+	}
+	if err = json.Unmarshal(body, &users); err != nil {
+		return 0, err
+	}
+	if len(users) == 0 {
+		return 0, fmt.Errorf("no user found with username %q", username)
+	}
+
+	return users[0].ID, nil
+}
+
+// rawUserEvent mirrors a single element of the /users/:id/events response.
+type rawUserEvent struct {
+	rawEvent
+	ProjectID int64 `json:"project_id"`
+}
+
+// fetchUserEvents fetches a user's activity feed, caching project lookups in projectsByID.
+func fetchUserEvents(url string, projectsByID map[int64]*Project, mu *sync.Mutex) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	_, body, err := doGet(req)
+	if err != nil {
+		return err
+	}
+
+	var rawEvents []rawUserEvent
+	if err = json.Unmarshal(body, &rawEvents); err != nil {
+		// Could happen on 504 or such which returns html instead of json
+		return err
+	}
+
+	var events []Event
+	for _, raw := range rawEvents {
+		mu.Lock()
+		project, found := projectsByID[raw.ProjectID]
+		mu.Unlock()
+
+		if !found {
+			fetched, err := fetchProjectByID(raw.ProjectID)
+			if err != nil {
+				log.Printf("Failed to fetch project=%d for user event: %s", raw.ProjectID, err)
+				continue
+			}
+			project = &fetched
+			mu.Lock()
+			projectsByID[raw.ProjectID] = project
+			mu.Unlock()
+		}
+
+		raw.rawEvent.Project = project
+		events = append(events, classifyRawEvent(raw.rawEvent))
+	}
+	addEvents(events)
+
+	return nil
+}
+
+// watchUser polls the first page of a user's activity feed every 5 seconds;
+// unlike watchProject it does not page back or back off when idle.
+func watchUser(username string) {
+	userID, err := resolveUserID(username)
+	if err != nil {
+		log.Printf("Failed to resolve user=%s: %s", username, err)
+		return
+	}
+
+	url := fmt.Sprintf("https://%s/api/v4/users/%d/events?private_token=%s", *gitlabURL, userID, *token)
+	projectsByID := make(map[int64]*Project)
+	var mu sync.Mutex
+
+	for {
+		if err := fetchUserEvents(url, projectsByID, &mu); err != nil {
+			log.Printf("Error when fetching events for user=%s: %s", username, err)
+			time.Sleep(1 * time.Second)
+		}
+
+		time.Sleep(5 * time.Second)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// EventKind discriminates the concrete Event implementations, since GitLab
+// event IDs are only unique per-endpoint.
+type EventKind int
+
+const (
+	KindNote EventKind = iota
+	KindPush
+	KindLabel
+	KindMilestone
+	KindIssueState
+	KindMergeRequestState
+	KindPipeline
+	KindAssignee
+	KindMentioned
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case KindNote:
+		return "note"
+	case KindPush:
+		return "push"
+	case KindLabel:
+		return "label"
+	case KindMilestone:
+		return "milestone"
+	case KindIssueState:
+		return "issue_state"
+	case KindMergeRequestState:
+		return "merge_request_state"
+	case KindPipeline:
+		return "pipeline"
+	case KindAssignee:
+		return "assignee"
+	case KindMentioned:
+		return "mentioned"
+	default:
+		return "unknown"
+	}
+}
+
+// parseEventKind is the inverse of EventKind.String.
+func parseEventKind(s string) (EventKind, bool) {
+	switch s {
+	case "note":
+		return KindNote, true
+	case "push":
+		return KindPush, true
+	case "label":
+		return KindLabel, true
+	case "milestone":
+		return KindMilestone, true
+	case "issue_state":
+		return KindIssueState, true
+	case "merge_request_state":
+		return KindMergeRequestState, true
+	case "pipeline":
+		return KindPipeline, true
+	case "assignee":
+		return KindAssignee, true
+	case "mentioned":
+		return KindMentioned, true
+	default:
+		return 0, false
+	}
+}
+
+// eventKey is the dedup/persistence key: (Kind, ID), since IDs alone collide across endpoints.
+type eventKey struct {
+	Kind EventKind
+	ID   int64
+}
+
+type TemplateContext struct {
+	Green, Gray, Reset, GitlabURL string
+}
+
+type Event interface {
+	ID() int64
+	CreatedAt() time.Time
+	Kind() EventKind
+	Author() string
+	Render(w io.Writer, ctx TemplateContext) error
+}
+
+// baseEvent holds the fields common to every event; concrete types embed it
+// to satisfy most of the Event interface for free.
+type baseEvent struct {
+	RawID        int64
+	RawCreatedAt time.Time
+	RawAuthor    string
+	Project      *Project
+	TargetTitle  string
+	TargetIID    int64
+	TargetType   string
+}
+
+func (b baseEvent) ID() int64            { return b.RawID }
+func (b baseEvent) CreatedAt() time.Time { return b.RawCreatedAt }
+func (b baseEvent) Author() string       { return b.RawAuthor }
+func (b baseEvent) ProjectID() int64     { return b.Project.ID }
+
+func targetURL(ctx TemplateContext, b baseEvent) string {
+	url := fmt.Sprintf("🔗 https://%s/%s", ctx.GitlabURL, b.Project.PathWithNamespace)
+	switch b.TargetType {
+	case "MergeRequest":
+		url += fmt.Sprintf("/-/merge_requests/%d", b.TargetIID)
+	case "Issue":
+		url += fmt.Sprintf("/-/issues/%d", b.TargetIID)
+	}
+	return url
+}
+
+type commonTemplateData struct {
+	Green, Gray, Reset       string
+	ProjectPathWithNamespace string
+	CreatedAt                string
+	TimeSince                string
+	Author                   string
+	TargetTitle              string
+	URL                      string
+}
+
+func newCommonTemplateData(b baseEvent, ctx TemplateContext) commonTemplateData {
+	return commonTemplateData{
+		Green:                    ctx.Green,
+		Gray:                     ctx.Gray,
+		Reset:                    ctx.Reset,
+		ProjectPathWithNamespace: b.Project.PathWithNamespace,
+		CreatedAt:                b.RawCreatedAt.Format(time.RFC3339),
+		TimeSince:                formatTimeSinceShort(time.Since(b.RawCreatedAt)),
+		Author:                   b.RawAuthor,
+		TargetTitle:              b.TargetTitle,
+		URL:                      targetURL(ctx, b),
+	}
+}
+
+var templateFuncs = template.FuncMap{"trunc": truncateString}
+
+var noteEventTemplate = template.Must(template.New("note").Funcs(templateFuncs).Parse(`
+{{.Green}}{{.ProjectPathWithNamespace}}{{.Gray}} {{.CreatedAt}} ({{.TimeSince}}){{.Green}} {{.Author}}{{.Gray}}: {{.Action}}{{.Reset}} {{trunc .TargetTitle 100}}
+💬 {{trunc .Body 400 -}}
+{{- if .Resolved}} {{.Green}}✔{{.Reset}}{{end}}
+{{.URL}}
+`))
+
+// NoteEvent is a comment left on an issue, merge request or commit.
+type NoteEvent struct {
+	baseEvent
+	Action   string
+	Body     string
+	Resolved bool
+}
+
+func (e NoteEvent) Kind() EventKind { return KindNote }
+
+func (e NoteEvent) Render(w io.Writer, ctx TemplateContext) error {
+	data := struct {
+		commonTemplateData
+		Action   string
+		Body     string
+		Resolved bool
+	}{newCommonTemplateData(e.baseEvent, ctx), e.Action, e.Body, e.Resolved}
+	return noteEventTemplate.Execute(w, &data)
+}
+
+var pushEventTemplate = template.Must(template.New("push").Funcs(templateFuncs).Parse(`
+{{.Green}}{{.ProjectPathWithNamespace}}{{.Gray}} {{.CreatedAt}} ({{.TimeSince}}){{.Green}} {{.Author}}{{.Gray}}: {{.Action}}{{.Reset}}
+⬆️  {{.Ref}} {{.CommitTitle}}
+{{.URL}}
+`))
+
+// PushEvent is a push of commits to a branch or tag.
+type PushEvent struct {
+	baseEvent
+	Action      string
+	Ref         string
+	RefType     string
+	CommitTitle string
+}
+
+func (e PushEvent) Kind() EventKind { return KindPush }
+
+func (e PushEvent) Render(w io.Writer, ctx TemplateContext) error {
+	data := struct {
+		commonTemplateData
+		Action      string
+		Ref         string
+		CommitTitle string
+	}{newCommonTemplateData(e.baseEvent, ctx), e.Action, e.Ref, e.CommitTitle}
+	return pushEventTemplate.Execute(w, &data)
+}
+
+var labelEventTemplate = template.Must(template.New("label").Funcs(templateFuncs).Parse(`
+{{.Green}}{{.ProjectPathWithNamespace}}{{.Gray}} {{.CreatedAt}} ({{.TimeSince}}){{.Green}} {{.Author}}{{.Gray}}: {{if .Added}}added{{else}}removed{{end}} label{{.Reset}} {{trunc .TargetTitle 100}}
+🏷️  ~{{.LabelName}}
+{{.URL}}
+`))
+
+// LabelEvent is a label being added to or removed from an issue or merge request.
+type LabelEvent struct {
+	baseEvent
+	LabelName string
+	Added     bool
+}
+
+func (e LabelEvent) Kind() EventKind { return KindLabel }
+
+func (e LabelEvent) Render(w io.Writer, ctx TemplateContext) error {
+	data := struct {
+		commonTemplateData
+		LabelName string
+		Added     bool
+	}{newCommonTemplateData(e.baseEvent, ctx), e.LabelName, e.Added}
+	return labelEventTemplate.Execute(w, &data)
+}
+
+var milestoneEventTemplate = template.Must(template.New("milestone").Funcs(templateFuncs).Parse(`
+{{.Green}}{{.ProjectPathWithNamespace}}{{.Gray}} {{.CreatedAt}} ({{.TimeSince}}){{.Green}} {{.Author}}{{.Gray}}: {{.Action}}{{.Reset}} {{trunc .TargetTitle 100}}
+{{.URL}}
+`))
+
+// MilestoneEvent is an issue or merge request being attached to or removed from a milestone.
+type MilestoneEvent struct {
+	baseEvent
+	Action string
+}
+
+func (e MilestoneEvent) Kind() EventKind { return KindMilestone }
+
+func (e MilestoneEvent) Render(w io.Writer, ctx TemplateContext) error {
+	data := struct {
+		commonTemplateData
+		Action string
+	}{newCommonTemplateData(e.baseEvent, ctx), e.Action}
+	return milestoneEventTemplate.Execute(w, &data)
+}
+
+var stateEventTemplate = template.Must(template.New("state").Funcs(templateFuncs).Parse(`
+{{.Green}}{{.ProjectPathWithNamespace}}{{.Gray}} {{.CreatedAt}} ({{.TimeSince}}){{.Green}} {{.Author}}{{.Gray}}: {{.Action}}{{.Reset}} {{trunc .TargetTitle 100}}
+{{.URL}}
+`))
+
+// StateEvent is an issue, merge request or pipeline changing state: opened,
+// closed, reopened, merged, or a pipeline status change.
+type StateEvent struct {
+	baseEvent
+	Action string
+}
+
+// Kind is derived from TargetType, not a single KindState, since Issue,
+// MergeRequest and Pipeline IDs are independent sequences that routinely
+// collide on the same number.
+func (e StateEvent) Kind() EventKind {
+	switch e.TargetType {
+	case "MergeRequest":
+		return KindMergeRequestState
+	case "Pipeline":
+		return KindPipeline
+	default:
+		return KindIssueState
+	}
+}
+
+func (e StateEvent) Render(w io.Writer, ctx TemplateContext) error {
+	data := struct {
+		commonTemplateData
+		Action string
+	}{newCommonTemplateData(e.baseEvent, ctx), e.Action}
+	return stateEventTemplate.Execute(w, &data)
+}
+
+var assigneeEventTemplate = template.Must(template.New("assignee").Funcs(templateFuncs).Parse(`
+{{.Green}}{{.ProjectPathWithNamespace}}{{.Gray}} {{.CreatedAt}} ({{.TimeSince}}){{.Green}} {{.Author}}{{.Gray}}: {{.Action}}{{.Reset}} {{trunc .TargetTitle 100}}
+{{.URL}}
+`))
+
+// AssigneeEvent is an issue or merge request being assigned to, or unassigned from, someone.
+type AssigneeEvent struct {
+	baseEvent
+	Action string
+}
+
+func (e AssigneeEvent) Kind() EventKind { return KindAssignee }
+
+func (e AssigneeEvent) Render(w io.Writer, ctx TemplateContext) error {
+	data := struct {
+		commonTemplateData
+		Action string
+	}{newCommonTemplateData(e.baseEvent, ctx), e.Action}
+	return assigneeEventTemplate.Execute(w, &data)
+}
+
+var mentionedEventTemplate = template.Must(template.New("mentioned").Funcs(templateFuncs).Parse(`
+{{.Green}}{{.ProjectPathWithNamespace}}{{.Gray}} {{.CreatedAt}} ({{.TimeSince}}){{.Green}} {{.Author}}{{.Gray}}: {{.Action}}{{.Reset}} {{trunc .TargetTitle 100}}
+{{.URL}}
+`))
+
+// MentionedEvent is the author being mentioned in an issue or merge request they don't own.
+type MentionedEvent struct {
+	baseEvent
+	Action string
+}
+
+func (e MentionedEvent) Kind() EventKind { return KindMentioned }
+
+func (e MentionedEvent) Render(w io.Writer, ctx TemplateContext) error {
+	data := struct {
+		commonTemplateData
+		Action string
+	}{newCommonTemplateData(e.baseEvent, ctx), e.Action}
+	return mentionedEventTemplate.Execute(w, &data)
+}
+
+// rawEvent mirrors a single element of the GitLab /events API response.
+type rawEvent struct {
+	ID             int64
+	CreatedAt      string `json:"created_at"`
+	AuthorUsername string `json:"author_username"`
+	Action         string `json:"action_name"`
+	TargetID       int64  `json:"target_id"`
+	TargetTitle    string `json:"target_title"`
+	TargetIID      int64  `json:"target_iid"`
+	TargetType     string `json:"target_type"`
+	Note           *Note
+	Push           *Push `json:"push_data"`
+	Project        *Project `json:"-"`
+}
+
+// classifyRawEvent picks the concrete Event type based on which sub-object is populated.
+// The dedup ID is aligned with the webhook path (target_id for notes/state changes, a
+// ref+sha hash for pushes) rather than the activity-feed's own ID, so the same resource
+// seen via both a webhook delivery and a poll dedups to one event.
+func classifyRawEvent(raw rawEvent) Event {
+	createdAt, _ := time.Parse(time.RFC3339, raw.CreatedAt)
+	base := baseEvent{
+		RawID:        raw.ID,
+		RawCreatedAt: createdAt,
+		RawAuthor:    raw.AuthorUsername,
+		Project:      raw.Project,
+		TargetTitle:  raw.TargetTitle,
+		TargetIID:    raw.TargetIID,
+		TargetType:   raw.TargetType,
+	}
+
+	switch {
+	case raw.Note != nil:
+		base.RawID = raw.TargetID
+		return NoteEvent{baseEvent: base, Action: raw.Action, Body: raw.Note.Body, Resolved: raw.Note.Resolved}
+	case raw.Push != nil:
+		base.RawID = stableID(raw.Push.Ref + raw.Push.CommitTo)
+		return PushEvent{baseEvent: base, Action: raw.Action, Ref: raw.Push.Ref, RefType: raw.Push.RefType, CommitTitle: raw.Push.CommitTitle}
+	case strings.Contains(raw.Action, "milestone"):
+		return MilestoneEvent{baseEvent: base, Action: raw.Action}
+	case strings.Contains(raw.Action, "assigned"):
+		return AssigneeEvent{baseEvent: base, Action: raw.Action}
+	case strings.Contains(raw.Action, "mentioned"):
+		return MentionedEvent{baseEvent: base, Action: raw.Action}
+	default:
+		base.RawID = raw.TargetID
+		return StateEvent{baseEvent: base, Action: raw.Action}
+	}
+}
+
+// rawLabelEvent mirrors a single element of the resource_label_events response.
+type rawLabelEvent struct {
+	ID        int64  `json:"id"`
+	CreatedAt string `json:"created_at"`
+	User      struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Action string `json:"action"` // "add" or "remove"
+	Label  struct {
+		Name string `json:"name"`
+	} `json:"label"`
+}
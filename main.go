@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"crypto/sha1"
 	"encoding/json"
 	"flag"
@@ -10,10 +9,12 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
 	"sort"
 	"strconv"
 	"sync"
-	"text/template"
+	"syscall"
 	"time"
 
 	"github.com/mattn/go-isatty"
@@ -24,6 +25,7 @@ var (
 	token      = flag.String("token", "", "Gitlab API token (private, do not share with others)")
 	gitlabURL  = flag.String("url", "gitlab.com", "Gitlab URL. Might be different from gitlab.com when self-hosting.")
 	jsonOutput = flag.Bool("json", false, "Output json for scripts to consume")
+	cacheDir   = flag.String("cache-dir", "", "Directory to persist HTTP cache entries (ETag/Last-Modified) across restarts")
 )
 
 var (
@@ -31,24 +33,17 @@ var (
 	_ResetColor                  = "\x1b[0m"
 	_GrayColor                   = "\x1b[38;5;250m"
 	_NewOrModifiedEvents []Event = nil
-	_EventChecksumsByID          = make(map[int64][]byte)
+	_EventChecksumsByID          = make(map[eventKey]checksumRecord)
 	_EventsMutex                 = &sync.Mutex{}
-	_Hasher                      = sha1.New()
+	_Cache                       = newHTTPCache("")
 )
 
-const (
-	eventTemplate = `
-{{.Green}}{{.ProjectPathWithNamespace}}{{.Gray}} {{.CreatedAt}} ({{.TimeSince}}){{.Green}} {{.Author}}{{.Gray}}: {{.EventAction}}{{.Reset}} {{trunc .TargetTitle 100}}
-{{- if .IsNote }}
-💬 {{trunc .Body 400 -}}
-{{- if .Resolved -}} {{.Green}} ✔{{.Reset -}}{{- end}}
-{{- end -}}
-{{- if .IsPush }}
-⬆️  {{.Ref}} {{.CommitTitle -}}
-{{- end}}
-{{ .URL }}
-`
-)
+// checksumRecord is what we remember about a previously-seen event.
+type checksumRecord struct {
+	Hash      []byte
+	CreatedAt time.Time
+	ProjectID int64
+}
 
 func truncateString(s string, maxLen int) string {
 	length := len(s)
@@ -59,22 +54,31 @@ func truncateString(s string, maxLen int) string {
 	}
 }
 
-type TemplateInput struct {
-	Green, ProjectPathWithNamespace, Gray, CreatedAt, Author, EventAction, Reset, TargetTitle, Body, Ref, CommitTitle, URL, TimeSince string
-	IsNote, IsPush, Resolved                                                                                                          bool
-}
-
 type Project struct {
 	ID                int64
 	PathWithNamespace string `json:"path_with_namespace"`
 	Name              string
 }
 
+var _ProjectEventsURLRe = regexp.MustCompile(`/projects/(\d+)/events`)
+
+// projectIDFromEventsURL recovers the project ID encoded in a cached /projects/:id/events URL.
+func projectIDFromEventsURL(url string) (int64, bool) {
+	m := _ProjectEventsURLRe.FindStringSubmatch(url)
+	if m == nil {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
 type Note struct {
-	Type        string
-	Body        string
-	Resolved    bool
-	NoteableIID int64 `json:"noteable_iid"`
+	Type     string
+	Body     string
+	Resolved bool
 }
 
 type Push struct {
@@ -82,83 +86,223 @@ type Push struct {
 	RefType     string `json:"ref_type"`
 	Ref         string
 	CommitTitle string `json:"commit_title"`
+	CommitTo    string `json:"commit_to"`
 }
 
-type Event struct {
-	ID             int64
-	CreatedAt      string `json:"created_at"`
-	AuthorUsername string `json:"author_username"`
-	Action         string `json:"action_name"`
-	TargetTitle    string `json:"target_title"`
-	TargetIID      int64  `json:"target_iid"`
-	TargetType     string `json:"target_type"`
-	Note           *Note
-	Push           *Push `json:"push_data"`
-	Project        *Project
-	JSON           []byte
-}
-
-func addEvents(events *[]Event) {
+// addEvents dedups events against _EventChecksumsByID and returns how many were new or changed.
+func addEvents(events []Event) int {
 	_EventsMutex.Lock()
 	defer _EventsMutex.Unlock()
 
-	for _, event := range *events {
-		hash := _Hasher.Sum(event.JSON)
+	added := 0
+	for _, event := range events {
+		hash, err := checksumEvent(event)
+		if err != nil {
+			log.Printf("Failed to marshal event for checksum: kind=%s id=%d err=%s", event.Kind(), event.ID(), err)
+			continue
+		}
+		key := eventKey{Kind: event.Kind(), ID: event.ID()}
+		record := checksumRecord{Hash: hash, CreatedAt: event.CreatedAt(), ProjectID: eventProjectID(event)}
 
-		existingHash, found := _EventChecksumsByID[event.ID]
+		existing, found := _EventChecksumsByID[key]
 		if !found {
 			_NewOrModifiedEvents = append(_NewOrModifiedEvents, event)
-			_EventChecksumsByID[event.ID] = hash
+			_EventChecksumsByID[key] = record
+			added++
 			continue
 		}
 
-		if !bytes.Equal(hash, existingHash) { // Updated
+		if string(hash) != string(existing.Hash) { // Updated
 			_NewOrModifiedEvents = append(_NewOrModifiedEvents, event)
-			_EventChecksumsByID[event.ID] = hash
+			_EventChecksumsByID[key] = record
+			added++
 		}
 	}
+	return added
 }
 
-func fetchProjectEvents(url string, project *Project) error {
-	resp, err := http.Get(url)
+func checksumEvent(event Event) ([]byte, error) {
+	data, err := json.Marshal(event)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	sum := sha1.Sum(data)
+	return sum[:], nil
+}
+
+// projectScoped lets addEvents and the state file bucket checksums per-project
+// without widening the public Event interface.
+type projectScoped interface {
+	ProjectID() int64
+}
+
+func eventProjectID(event Event) int64 {
+	if scoped, ok := event.(projectScoped); ok {
+		return scoped.ProjectID()
+	}
+	return 0
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+// isKnownUnchanged reports whether fetchProjectEvents has paged far enough back to stop.
+func isKnownUnchanged(event Event) bool {
+	hash, err := checksumEvent(event)
 	if err != nil {
-		return err
+		return false
 	}
 
-	log.Printf("%s", body)
+	_EventsMutex.Lock()
+	defer _EventsMutex.Unlock()
+	existing, found := _EventChecksumsByID[eventKey{Kind: event.Kind(), ID: event.ID()}]
+	return found && string(existing.Hash) == string(hash)
+}
 
+// fetchProjectEvents walks a project's /events pages, fanning out to
+// resource_label_events for every merge request it mentions, until it hits
+// an empty page or catches up with the last poll.
+func fetchProjectEvents(baseURL string, project *Project) (int, error) {
 	var events []Event
-	if err = json.Unmarshal(body, &events); err != nil {
-		// Could happen on 504 or such which returns html instead of json
-		return err
+	seenMergeRequestIIDs := make(map[int64]bool)
+	var firstPageBody []byte
+	var etag, lastModified string
+
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s&per_page=100&page=%d", baseURL, page)
+
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return 0, err
+		}
+		if page == 1 {
+			_Cache.applyConditionalHeaders(req, baseURL)
+		}
+
+		resp, body, err := doGet(req)
+		if err != nil {
+			return 0, err
+		}
+
+		if resp.StatusCode == http.StatusNotModified {
+			if *verbose {
+				log.Printf("X-From-Cache: 1 project=%s", project.PathWithNamespace)
+			}
+			return 0, nil
+		}
+
+		if page == 1 {
+			firstPageBody = body
+			etag = resp.Header.Get("ETag")
+			lastModified = resp.Header.Get("Last-Modified")
+		}
+
+		log.Printf("%s", body)
+
+		var rawEvents []rawEvent
+		if err = json.Unmarshal(body, &rawEvents); err != nil {
+			// Could happen on 504 or such which returns html instead of json
+			return 0, err
+		}
+		if len(rawEvents) == 0 {
+			break
+		}
+
+		caughtUp := false
+		for _, raw := range rawEvents {
+			raw.Project = project
+			event := classifyRawEvent(raw)
+			if isKnownUnchanged(event) {
+				caughtUp = true
+				break
+			}
+			events = append(events, event)
+
+			if raw.TargetType == "MergeRequest" && !seenMergeRequestIIDs[raw.TargetIID] {
+				seenMergeRequestIIDs[raw.TargetIID] = true
+
+				labelEvents, err := fetchLabelEvents(project, raw.TargetIID)
+				if err != nil {
+					log.Printf("Failed to fetch label events: project=%d mr=%d err=%s", project.ID, raw.TargetIID, err)
+					continue
+				}
+				events = append(events, labelEvents...)
+			}
+		}
+
+		if caughtUp || len(rawEvents) < 100 {
+			break
+		}
+	}
+
+	var mostRecent time.Time
+	for _, event := range events {
+		if event.CreatedAt().After(mostRecent) {
+			mostRecent = event.CreatedAt()
+		}
+	}
+	if !mostRecent.IsZero() {
+		recordLastSeen(project.ID, mostRecent)
+	}
+
+	added := addEvents(events)
+
+	if etag != "" || lastModified != "" {
+		_Cache.put(baseURL, &cacheEntry{
+			ETag:         etag,
+			LastModified: lastModified,
+			Body:         firstPageBody,
+		})
+	}
+
+	return added, nil
+}
+
+func fetchLabelEvents(project *Project, mergeRequestIID int64) ([]Event, error) {
+	url := fmt.Sprintf("https://%s/api/v4/projects/%d/merge_requests/%d/resource_label_events?private_token=%s",
+		*gitlabURL, project.ID, mergeRequestIID, *token)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	for i := range events {
-		events[i].JSON, _ = json.Marshal(&events[i])
-		events[i].Project = project
+	_, body, err := doGet(req)
+	if err != nil {
+		return nil, err
 	}
-	addEvents(&events)
 
-	return nil
+	var raws []rawLabelEvent
+	if err = json.Unmarshal(body, &raws); err != nil {
+		return nil, err
+	}
+
+	events := make([]Event, 0, len(raws))
+	for _, raw := range raws {
+		createdAt, _ := time.Parse(time.RFC3339, raw.CreatedAt)
+		events = append(events, LabelEvent{
+			baseEvent: baseEvent{
+				RawID:        raw.ID,
+				RawCreatedAt: createdAt,
+				RawAuthor:    raw.User.Username,
+				Project:      project,
+				TargetIID:    mergeRequestIID,
+				TargetType:   "MergeRequest",
+			},
+			LabelName: raw.Label.Name,
+			Added:     raw.Action == "add",
+		})
+	}
+	return events, nil
 }
 
 func fetchProjectByID(projectID int64) (Project, error) {
 	url := fmt.Sprintf("https://%s/api/v4/projects/%d?simple=true&private_token=%s", *gitlabURL, projectID, *token)
 	project := Project{}
 
-	resp, err := http.Get(url)
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return project, err
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+	_, body, err := doGet(req)
 	if err != nil {
 		return project, err
 	}
@@ -171,16 +315,38 @@ func fetchProjectByID(projectID int64) (Project, error) {
 	return project, nil
 }
 
+const (
+	_MinPollInterval = 5 * time.Second
+	_MaxPollInterval = 60 * time.Second
+)
+
+// watchProject polls a project's events, backing off up to _MaxPollInterval
+// when idle and resetting to _MinPollInterval as soon as activity resumes.
 func watchProject(project *Project) {
 	url := fmt.Sprintf("https://%s/api/v4/projects/%d/events?private_token=%s", *gitlabURL, project.ID, *token)
+	if lastSeenAt, found := lookupLastSeen(project.ID); found {
+		url += "&after=" + lastSeenAt.Add(-24*time.Hour).Format("2006-01-02")
+	}
 
+	interval := _MinPollInterval
 	for {
-		if err := fetchProjectEvents(url, project); err != nil {
+		added, err := fetchProjectEvents(url, project)
+		if err != nil {
 			log.Printf("Error when fetching events for project %d: %s", project.ID, err)
 			time.Sleep(1 * time.Second)
+			continue
 		}
 
-		time.Sleep(5 * time.Second)
+		if added > 0 {
+			interval = _MinPollInterval
+		} else {
+			interval *= 2
+			if interval > _MaxPollInterval {
+				interval = _MaxPollInterval
+			}
+		}
+
+		time.Sleep(interval)
 	}
 }
 
@@ -218,9 +384,11 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
-	projectIDsStr := flag.Args()
-	if len(projectIDsStr) == 0 {
-		fmt.Fprintln(os.Stderr, "Missing project id(s) to watch")
+	initRateLimiter()
+
+	targetsStr := flag.Args()
+	if len(targetsStr) == 0 && *listen == "" {
+		fmt.Fprintln(os.Stderr, "Missing project:/group:/user: target(s) to watch (or pass -listen to run in webhook mode)")
 		os.Exit(1)
 	}
 
@@ -230,27 +398,119 @@ func main() {
 		_GrayColor = ""
 	}
 
-	for _, projectIDStr := range projectIDsStr {
-		log.Printf("Handling projectID=%s", projectIDStr)
-		projectID, err := strconv.ParseInt(projectIDStr, 10, 64)
+	var store *stateStore
+	if *stateFile != "" {
+		store = newStateStore(*stateFile)
+		state, err := store.load()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Invalid project id %s: %s\n", projectIDStr, err)
+			log.Printf("Failed to load state file %s: %s", *stateFile, err)
+		} else {
+			restoreState(state)
+		}
+	}
+
+	if *cacheDir != "" {
+		_Cache = newHTTPCache(*cacheDir)
+		if err := _Cache.load(); err != nil {
+			log.Printf("Failed to load HTTP cache from %s: %s", *cacheDir, err)
+		}
+		for url, entry := range _Cache.entries {
+			var rawEvents []rawEvent
+			if err := json.Unmarshal(entry.Body, &rawEvents); err != nil {
+				log.Printf("Failed to decode cached body for %s: %s", url, err)
+				continue
+			}
+			projectID, ok := projectIDFromEventsURL(url)
+			if !ok {
+				log.Printf("Failed to recover project ID from cached URL %s", url)
+				continue
+			}
+			// The checksum covers the whole Project, so prime with the same
+			// Project the poller attaches or the hashes never match.
+			fetched, err := fetchProjectByID(projectID)
+			if err != nil {
+				log.Printf("Failed to fetch project=%d for cached URL %s: %s", projectID, url, err)
+				continue
+			}
+			project := &fetched
+			events := make([]Event, 0, len(rawEvents))
+			for _, raw := range rawEvents {
+				raw.Project = project
+				events = append(events, classifyRawEvent(raw))
+			}
+			primeEventChecksums(events)
+		}
+	}
+
+	for _, targetStr := range targetsStr {
+		log.Printf("Handling target=%s", targetStr)
+		t, err := parseTarget(targetStr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid target %s: %s\n", targetStr, err)
 			os.Exit(1)
 		}
 
+		switch t.kind {
+		case targetProject:
+			projectID := t.id
+			go func() {
+				project, err := fetchProjectByID(projectID)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to fetch the project information: id=%d err=%s\n", projectID, err)
+					os.Exit(1)
+				}
+				log.Printf("Fetched info for projectID=%d", projectID)
+
+				watchProject(&project)
+			}()
+		case targetGroup:
+			groupID := t.id
+			if !*discover {
+				fmt.Fprintf(os.Stderr, "group:%d given but -discover is not set\n", groupID)
+				os.Exit(1)
+			}
+			go watchGroup(groupID)
+		case targetUser:
+			username := t.name
+			go watchUser(username)
+		}
+	}
+
+	if *listen != "" {
 		go func() {
-			project, err := fetchProjectByID(projectID)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to fetch the project information: id=%d err=%s\n", projectID, err)
+			if err := startWebhookServer(*listen); err != nil {
+				fmt.Fprintf(os.Stderr, "Webhook server failed: %s\n", err)
 				os.Exit(1)
 			}
-			log.Printf("Fetched info for projectID=%d", projectID)
+		}()
+	}
 
-			watchProject(&project)
+	if store != nil {
+		go func() {
+			ticker := time.NewTicker(stateSaveInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				gcEventChecksums(*retention)
+				if err := store.save(); err != nil {
+					log.Printf("Failed to save state file %s: %s", *stateFile, err)
+				}
+			}
+		}()
+
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigCh
+			log.Printf("Shutting down, saving state file %s", *stateFile)
+			gcEventChecksums(*retention)
+			if err := store.save(); err != nil {
+				log.Printf("Failed to save state file %s: %s", *stateFile, err)
+			}
+			os.Exit(0)
 		}()
 	}
 
-	t := template.Must(template.New("event").Funcs(template.FuncMap{"trunc": truncateString}).Parse(eventTemplate))
+	ctx := TemplateContext{Green: _GreenColor, Gray: _GrayColor, Reset: _ResetColor, GitlabURL: *gitlabURL}
 
 	for {
 		_EventsMutex.Lock()
@@ -258,48 +518,22 @@ func main() {
 		copy(events, _NewOrModifiedEvents)
 		_NewOrModifiedEvents = nil
 		_EventsMutex.Unlock()
-		sort.Slice(events, func(i, j int) bool { return events[i].CreatedAt < events[j].CreatedAt })
+		sort.Slice(events, func(i, j int) bool { return events[i].CreatedAt().Before(events[j].CreatedAt()) })
 
 		for _, event := range events {
 			if *jsonOutput {
-				fmt.Println(string(event.JSON))
-
+				data, err := json.Marshal(event)
+				if err != nil {
+					log.Printf("Failed to marshal event to json: kind=%s id=%d err=%s", event.Kind(), event.ID(), err)
+					continue
+				}
+				fmt.Println(string(data))
 				continue
 			}
 
-			createdAt, err := time.Parse(time.RFC3339, event.CreatedAt)
-			if err != nil {
-				log.Printf("Failed to parse date: CreatedAt=%s err=%s", event.CreatedAt, err)
+			if err := event.Render(os.Stdout, ctx); err != nil {
+				log.Printf("Failed to render event: kind=%s id=%d err=%s", event.Kind(), event.ID(), err)
 			}
-
-			url := fmt.Sprintf("🔗 https://%s/%s", *gitlabURL, event.Project.PathWithNamespace)
-			if event.Note != nil {
-				url += fmt.Sprintf("/-/merge_requests/%d", event.Note.NoteableIID)
-			} else if event.TargetType == "MergeRequest" {
-				url += fmt.Sprintf("/-/merge_requests/%d", event.TargetIID)
-			}
-			templateInput := TemplateInput{
-				Green:                    _GreenColor,
-				Gray:                     _GrayColor,
-				Reset:                    _ResetColor,
-				CreatedAt:                event.CreatedAt,
-				Author:                   event.AuthorUsername,
-				TargetTitle:              event.TargetTitle,
-				ProjectPathWithNamespace: event.Project.PathWithNamespace,
-				URL:                      url,
-				TimeSince:                formatTimeSinceShort(time.Since(createdAt)),
-				EventAction:              event.Action}
-			if event.Note != nil {
-				templateInput.IsNote = true
-				templateInput.Resolved = event.Note.Resolved
-				templateInput.Body = event.Note.Body
-			} else if event.Push != nil {
-				templateInput.IsPush = true
-				templateInput.Ref = event.Push.Ref
-				templateInput.CommitTitle = event.Push.CommitTitle
-			}
-
-			t.Execute(os.Stdout, &templateInput)
 		}
 		time.Sleep(1 * time.Second)
 	}
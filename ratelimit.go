@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var rps = flag.Float64("rps", 10, "Max requests per second to the Gitlab API, shared across all watched targets")
+
+const _MaxRetries = 5
+
+var _RateLimiter *rate.Limiter
+
+// initRateLimiter must run after flag.Parse() so it picks up -rps.
+func initRateLimiter() {
+	_RateLimiter = rate.NewLimiter(rate.Limit(*rps), 1)
+}
+
+// doGet executes req against the shared rate limiter, retrying 5xx/429 with
+// backoff and jitter (honoring Retry-After) up to _MaxRetries times.
+func doGet(req *http.Request) (*http.Response, []byte, error) {
+	var lastErr error
+
+	for attempt := 0; attempt <= _MaxRetries; attempt++ {
+		if err := _RateLimiter.Wait(req.Context()); err != nil {
+			return nil, nil, err
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			lastErr = err
+			sleepBackoff(attempt, 0)
+			continue
+		}
+
+		if resp.StatusCode == http.StatusNotModified {
+			return resp, nil, nil
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+			resp.Body.Close()
+			lastErr = fmt.Errorf("gitlab returned status %d for %s", resp.StatusCode, req.URL.Path)
+			sleepBackoff(attempt, retryAfter)
+			continue
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, body, err
+	}
+
+	return nil, nil, lastErr
+}
+
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	return 0
+}
+
+func sleepBackoff(attempt int, retryAfter time.Duration) {
+	wait := time.Duration(1<<uint(attempt))*time.Second + time.Duration(rand.Int63n(int64(time.Second)))
+	if retryAfter > wait {
+		wait = retryAfter
+	}
+
+	if *verbose {
+		log.Printf("Retrying in %v (attempt %d)", wait, attempt+1)
+	}
+	time.Sleep(wait)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	stateFile         = flag.String("state-file", "", "JSON file to persist event checksums and each project's last-seen timestamp across restarts")
+	retention         = flag.Duration("retention", 90*24*time.Hour, "How long to keep event checksums before garbage-collecting them")
+	stateSaveInterval = 30 * time.Second
+)
+
+var (
+	_LastSeenAtByProject = make(map[int64]time.Time)
+	_LastSeenMutex       = &sync.Mutex{}
+)
+
+// recordLastSeen bumps the last-seen timestamp for a project, ignoring older updates.
+func recordLastSeen(projectID int64, t time.Time) {
+	_LastSeenMutex.Lock()
+	defer _LastSeenMutex.Unlock()
+	if t.After(_LastSeenAtByProject[projectID]) {
+		_LastSeenAtByProject[projectID] = t
+	}
+}
+
+func lookupLastSeen(projectID int64) (time.Time, bool) {
+	_LastSeenMutex.Lock()
+	defer _LastSeenMutex.Unlock()
+	t, found := _LastSeenAtByProject[projectID]
+	return t, found
+}
+
+// persistedProjectState is what the state file remembers about a single project.
+type persistedProjectState struct {
+	LastSeenAt time.Time         `json:"last_seen_at"`
+	Checksums  map[string]string `json:"checksums"` // "kind:id" -> hex-encoded hash
+}
+
+type persistedState struct {
+	Projects map[int64]*persistedProjectState `json:"projects"`
+}
+
+// stateStore persists persistedState to a JSON file, atomically (tmpfile + rename).
+type stateStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func newStateStore(path string) *stateStore {
+	return &stateStore{path: path}
+}
+
+func (s *stateStore) load() (*persistedState, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return &persistedState{Projects: make(map[int64]*persistedProjectState)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if state.Projects == nil {
+		state.Projects = make(map[int64]*persistedProjectState)
+	}
+	return &state, nil
+}
+
+func (s *stateStore) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(snapshotState(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// snapshotState buckets the in-memory checksums by project for the state file's schema.
+func snapshotState() persistedState {
+	_EventsMutex.Lock()
+	byProject := make(map[int64]map[string]string)
+	for key, record := range _EventChecksumsByID {
+		checksums, ok := byProject[record.ProjectID]
+		if !ok {
+			checksums = make(map[string]string)
+			byProject[record.ProjectID] = checksums
+		}
+		checksums[checksumKey(key)] = hex.EncodeToString(record.Hash)
+	}
+	_EventsMutex.Unlock()
+
+	_LastSeenMutex.Lock()
+	defer _LastSeenMutex.Unlock()
+
+	projects := make(map[int64]*persistedProjectState, len(byProject))
+	for projectID, checksums := range byProject {
+		projects[projectID] = &persistedProjectState{
+			LastSeenAt: _LastSeenAtByProject[projectID],
+			Checksums:  checksums,
+		}
+	}
+	return persistedState{Projects: projects}
+}
+
+// restoreState seeds _EventChecksumsByID and _LastSeenAtByProject from a loaded state file.
+func restoreState(state *persistedState) {
+	_EventsMutex.Lock()
+	for projectID, ps := range state.Projects {
+		for keyStr, hexHash := range ps.Checksums {
+			key, ok := parseChecksumKey(keyStr)
+			if !ok {
+				continue
+			}
+			hash, err := hex.DecodeString(hexHash)
+			if err != nil {
+				log.Printf("Failed to decode persisted checksum for project=%d key=%s: %s", projectID, keyStr, err)
+				continue
+			}
+			_EventChecksumsByID[key] = checksumRecord{Hash: hash, CreatedAt: ps.LastSeenAt, ProjectID: projectID}
+		}
+	}
+	_EventsMutex.Unlock()
+
+	_LastSeenMutex.Lock()
+	for projectID, ps := range state.Projects {
+		_LastSeenAtByProject[projectID] = ps.LastSeenAt
+	}
+	_LastSeenMutex.Unlock()
+}
+
+func checksumKey(key eventKey) string {
+	return key.Kind.String() + ":" + strconv.FormatInt(key.ID, 10)
+}
+
+func parseChecksumKey(s string) (eventKey, bool) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return eventKey{}, false
+	}
+	kindStr, idStr := parts[0], parts[1]
+	kind, ok := parseEventKind(kindStr)
+	if !ok {
+		return eventKey{}, false
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return eventKey{}, false
+	}
+	return eventKey{Kind: kind, ID: id}, true
+}
+
+// gcEventChecksums drops checksums older than retention.
+func gcEventChecksums(retention time.Duration) {
+	_EventsMutex.Lock()
+	defer _EventsMutex.Unlock()
+
+	cutoff := time.Now().Add(-retention)
+	for key, record := range _EventChecksumsByID {
+		if record.CreatedAt.Before(cutoff) {
+			delete(_EventChecksumsByID, key)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	listen        = flag.String("listen", "", "Address to listen on for Gitlab webhook deliveries, e.g. :8080. Runs alongside any polling targets given as positional arguments.")
+	webhookSecret = flag.String("webhook-secret", "", "Expected value of the X-Gitlab-Token header on incoming webhook deliveries")
+)
+
+// startWebhookServer runs an HTTP server accepting Gitlab webhook deliveries at
+// /webhook, pushing them through the same addEvents pipeline as the poller.
+func startWebhookServer(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhook", handleWebhook)
+	log.Printf("Listening for Gitlab webhooks on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if *webhookSecret != "" && r.Header.Get("X-Gitlab-Token") != *webhookSecret {
+		http.Error(w, "invalid X-Gitlab-Token", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	hookType := r.Header.Get("X-Gitlab-Event")
+	event, err := decodeWebhookEvent(hookType, body)
+	if err != nil {
+		log.Printf("Failed to decode webhook delivery: event=%s err=%s", hookType, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	addEvents([]Event{event})
+	w.WriteHeader(http.StatusOK)
+}
+
+func decodeWebhookEvent(hookType string, body []byte) (Event, error) {
+	switch hookType {
+	case "Push Hook":
+		return decodePushHook(body)
+	case "Note Hook":
+		return decodeNoteHook(body)
+	case "Merge Request Hook":
+		return decodeStateHook(body, "MergeRequest")
+	case "Issue Hook":
+		return decodeStateHook(body, "Issue")
+	case "Pipeline Hook":
+		return decodePipelineHook(body)
+	default:
+		return nil, fmt.Errorf("unhandled X-Gitlab-Event: %q", hookType)
+	}
+}
+
+// webhookProject is the subset of a Gitlab webhook payload's "project" object we care about.
+type webhookProject struct {
+	ID                int64  `json:"id"`
+	PathWithNamespace string `json:"path_with_namespace"`
+}
+
+// stableID derives a deterministic int64 ID for webhook payloads that don't carry one of their own.
+func stableID(s string) int64 {
+	sum := sha1.Sum([]byte(s))
+	return int64(binary.BigEndian.Uint64(sum[:8]))
+}
+
+func decodePushHook(body []byte) (Event, error) {
+	var payload struct {
+		UserUsername string         `json:"user_username"`
+		Ref          string         `json:"ref"`
+		CheckoutSHA  string         `json:"checkout_sha"`
+		Project      webhookProject `json:"project"`
+		Commits      []struct {
+			Title string `json:"title"`
+		} `json:"commits"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	var commitTitle string
+	if len(payload.Commits) > 0 {
+		commitTitle = payload.Commits[len(payload.Commits)-1].Title
+	}
+
+	return PushEvent{
+		baseEvent: baseEvent{
+			RawID:        stableID(payload.Ref + payload.CheckoutSHA),
+			RawCreatedAt: time.Now(),
+			RawAuthor:    payload.UserUsername,
+			Project:      &Project{ID: payload.Project.ID, PathWithNamespace: payload.Project.PathWithNamespace},
+		},
+		Action:      "pushed to",
+		Ref:         payload.Ref,
+		CommitTitle: commitTitle,
+	}, nil
+}
+
+func decodeNoteHook(body []byte) (Event, error) {
+	var payload struct {
+		User    struct{ Username string } `json:"user"`
+		Project webhookProject             `json:"project"`
+		ObjectAttributes struct {
+			ID        int64  `json:"id"`
+			Note      string `json:"note"`
+			CreatedAt string `json:"created_at"`
+			Resolved  bool   `json:"resolved"`
+		} `json:"object_attributes"`
+		MergeRequest *struct {
+			IID   int64  `json:"iid"`
+			Title string `json:"title"`
+		} `json:"merge_request"`
+		Issue *struct {
+			IID   int64  `json:"iid"`
+			Title string `json:"title"`
+		} `json:"issue"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	targetType, targetIID, targetTitle := "", int64(0), ""
+	switch {
+	case payload.MergeRequest != nil:
+		targetType, targetIID, targetTitle = "MergeRequest", payload.MergeRequest.IID, payload.MergeRequest.Title
+	case payload.Issue != nil:
+		targetType, targetIID, targetTitle = "Issue", payload.Issue.IID, payload.Issue.Title
+	}
+
+	createdAt, _ := time.Parse(time.RFC3339, payload.ObjectAttributes.CreatedAt)
+
+	return NoteEvent{
+		baseEvent: baseEvent{
+			RawID:        payload.ObjectAttributes.ID,
+			RawCreatedAt: createdAt,
+			RawAuthor:    payload.User.Username,
+			Project:      &Project{ID: payload.Project.ID, PathWithNamespace: payload.Project.PathWithNamespace},
+			TargetTitle:  targetTitle,
+			TargetIID:    targetIID,
+			TargetType:   targetType,
+		},
+		Action:   "commented on",
+		Body:     payload.ObjectAttributes.Note,
+		Resolved: payload.ObjectAttributes.Resolved,
+	}, nil
+}
+
+// decodeStateHook handles both Merge Request Hook and Issue Hook, which share the same shape.
+func decodeStateHook(body []byte, targetType string) (Event, error) {
+	var payload struct {
+		User             struct{ Username string } `json:"user"`
+		Project          webhookProject             `json:"project"`
+		ObjectAttributes struct {
+			ID        int64  `json:"id"`
+			IID       int64  `json:"iid"`
+			Title     string `json:"title"`
+			Action    string `json:"action"`
+			CreatedAt string `json:"created_at"`
+		} `json:"object_attributes"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	createdAt, _ := time.Parse(time.RFC3339, payload.ObjectAttributes.CreatedAt)
+
+	return StateEvent{
+		baseEvent: baseEvent{
+			RawID:        payload.ObjectAttributes.ID,
+			RawCreatedAt: createdAt,
+			RawAuthor:    payload.User.Username,
+			Project:      &Project{ID: payload.Project.ID, PathWithNamespace: payload.Project.PathWithNamespace},
+			TargetTitle:  payload.ObjectAttributes.Title,
+			TargetIID:    payload.ObjectAttributes.IID,
+			TargetType:   targetType,
+		},
+		Action: payload.ObjectAttributes.Action,
+	}, nil
+}
+
+func decodePipelineHook(body []byte) (Event, error) {
+	var payload struct {
+		User             struct{ Username string } `json:"user"`
+		Project          webhookProject             `json:"project"`
+		ObjectAttributes struct {
+			ID        int64  `json:"id"`
+			Status    string `json:"status"`
+			CreatedAt string `json:"created_at"`
+		} `json:"object_attributes"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	createdAt, _ := time.Parse(time.RFC3339, payload.ObjectAttributes.CreatedAt)
+
+	return StateEvent{
+		baseEvent: baseEvent{
+			RawID:        payload.ObjectAttributes.ID,
+			RawCreatedAt: createdAt,
+			RawAuthor:    payload.User.Username,
+			Project:      &Project{ID: payload.Project.ID, PathWithNamespace: payload.Project.PathWithNamespace},
+			TargetTitle:  fmt.Sprintf("Pipeline #%d", payload.ObjectAttributes.ID),
+			TargetType:   "Pipeline",
+		},
+		Action: "pipeline " + payload.ObjectAttributes.Status,
+	}, nil
+}